@@ -0,0 +1,195 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dockerConfig is the subset of ~/.docker/config.json we need to resolve
+// registry credentials: either an inline base64 "auths" entry, or a
+// credential helper (a per-registry one in credHelpers, or the global
+// credsStore).
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth string `json:"auth"`
+	} `json:"auths"`
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+// loadDockerConfig reads ~/.docker/config.json, returning a zero-value
+// config (no credentials configured, no error) when it doesn't exist.
+func loadDockerConfig() (dockerConfig, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return dockerConfig{}, fmt.Errorf("error locating home directory: %w", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(home, ".docker", "config.json"))
+	if os.IsNotExist(err) {
+		return dockerConfig{}, nil
+	}
+	if err != nil {
+		return dockerConfig{}, fmt.Errorf("error reading docker config: %w", err)
+	}
+
+	var cfg dockerConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return dockerConfig{}, fmt.Errorf("error parsing docker config: %w", err)
+	}
+
+	return cfg, nil
+}
+
+// hubCredentialsKey is the key Docker's own config.json stores Hub
+// credentials under - not the Hub API hostname ("registry.hub.docker.com")
+// that we actually pull blobs/manifests from.
+const hubCredentialsKey = "https://index.docker.io/v1/"
+
+// credentialsKey maps a registry host to the key its credentials are
+// filed under in ~/.docker/config.json, per real Docker clients.
+func credentialsKey(registry string) string {
+	if registry == defaultRegistry || registry == "docker.io" {
+		return hubCredentialsKey
+	}
+	return registry
+}
+
+// registryCredentials resolves a username/password for registry out of
+// cfg: a credential helper (per-registry credHelpers, falling back to the
+// global credsStore) takes precedence over an inline "auths" entry.
+// ok is false when registry has no credentials configured at all (or a
+// helper reports none found), which isn't an error - plenty of registries
+// are pulled from anonymously.
+func registryCredentials(cfg dockerConfig, registry string) (username, password string, ok bool, err error) {
+	key := credentialsKey(registry)
+
+	if helper, found := cfg.CredHelpers[key]; found {
+		return runCredentialHelper(helper, key)
+	}
+
+	if cfg.CredsStore != "" {
+		return runCredentialHelper(cfg.CredsStore, key)
+	}
+
+	entry, found := cfg.Auths[key]
+	if !found || entry.Auth == "" {
+		return "", "", false, nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+	if err != nil {
+		return "", "", false, fmt.Errorf("error decoding auth for %s: %w", key, err)
+	}
+
+	username, password, found = strings.Cut(string(decoded), ":")
+	return username, password, found, nil
+}
+
+// credentialHelperResponse is what "docker-credential-<name> get" prints
+// to stdout, per the credential helper protocol
+// (https://github.com/docker/docker-credential-helpers).
+type credentialHelperResponse struct {
+	Username string
+	Secret   string
+}
+
+// runCredentialHelper execs "docker-credential-<name> get", writing key
+// to its stdin and parsing the username/secret it prints back. A helper
+// reporting "credentials not found" - the normal response for a registry
+// the user never `docker login`'d into - isn't an error: it just means
+// pull anonymously, the same as no credsStore/credHelpers entry at all.
+func runCredentialHelper(name, key string) (username, password string, ok bool, err error) {
+	cmd := exec.Command(fmt.Sprintf("docker-credential-%s", name), "get")
+	cmd.Stdin = strings.NewReader(key)
+
+	out, err := cmd.Output()
+	if err != nil {
+		if credentialsNotFound(err) {
+			return "", "", false, nil
+		}
+		return "", "", false, fmt.Errorf("error running credential helper %q for %s: %w", name, key, err)
+	}
+
+	var resp credentialHelperResponse
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return "", "", false, fmt.Errorf("error parsing credential helper %q output: %w", name, err)
+	}
+	if resp.Username == "" && resp.Secret == "" {
+		return "", "", false, nil
+	}
+
+	return resp.Username, resp.Secret, true, nil
+}
+
+// credentialsNotFound reports whether err is a credential helper exiting
+// non-zero because it has nothing stored for the requested key, per the
+// docker-credential-helpers convention of printing that message to
+// stderr (e.g. "credentials not found in native keychain").
+func credentialsNotFound(err error) bool {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return false
+	}
+	return strings.Contains(strings.ToLower(string(exitErr.Stderr)), "credentials not found")
+}
+
+// tokenCacheKey identifies a cached bearer token by the registry,
+// repository, and scope it was issued for.
+type tokenCacheKey struct {
+	registry   string
+	repository string
+	scope      string
+}
+
+type cachedToken struct {
+	token   string
+	expires time.Time
+}
+
+var (
+	tokenCacheMu sync.Mutex
+	tokenCache   = map[tokenCacheKey]cachedToken{}
+)
+
+// cachedTokenFor returns a still-valid cached token for key, if any.
+func cachedTokenFor(key tokenCacheKey) (string, bool) {
+	tokenCacheMu.Lock()
+	defer tokenCacheMu.Unlock()
+
+	entry, ok := tokenCache[key]
+	if !ok || !time.Now().Before(entry.expires) {
+		return "", false
+	}
+
+	return entry.token, true
+}
+
+// storeToken caches resp's token under key until it expires, derived
+// from expires_in/issued_at (falling back to a conservative 60s lifetime
+// when the registry omits them).
+func storeToken(key tokenCacheKey, resp TokenResponse) {
+	ttl := time.Duration(resp.ExpiresIn) * time.Second
+	if ttl <= 0 {
+		ttl = 60 * time.Second
+	}
+	issued := resp.IssuedAt
+	if issued.IsZero() {
+		issued = time.Now()
+	}
+
+	tokenCacheMu.Lock()
+	defer tokenCacheMu.Unlock()
+	tokenCache[key] = cachedToken{token: resp.Token, expires: issued.Add(ttl)}
+}
@@ -0,0 +1,223 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// maxConcurrentPulls bounds how many layer blobs are downloaded at once.
+const maxConcurrentPulls = 4
+
+// pullLayers fetches every distinct layer digest in layers through the
+// blob cache, up to maxConcurrentPulls at a time, and returns each
+// layer's local file path in the same order as layers. A digest repeated
+// across layers (duplicate content layers do occur) is only fetched
+// once - besides the wasted work, fetching it twice concurrently would
+// race two goroutines over the same cache/partial-download file.
+func pullLayers(ref Reference, token string, layers []LayerDescriptor) ([]string, error) {
+	paths := make([]string, len(layers))
+	errs := make([]error, len(layers))
+
+	indicesByDigest := make(map[string][]int, len(layers))
+	var digests []string
+	for i, layer := range layers {
+		if _, seen := indicesByDigest[layer.Digest]; !seen {
+			digests = append(digests, layer.Digest)
+		}
+		indicesByDigest[layer.Digest] = append(indicesByDigest[layer.Digest], i)
+	}
+
+	sem := make(chan struct{}, maxConcurrentPulls)
+	var wg sync.WaitGroup
+
+	for _, digest := range digests {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(digest string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			path, err := fetchLayer(ref, token, digest)
+			for _, i := range indicesByDigest[digest] {
+				paths[i], errs[i] = path, err
+			}
+		}(digest)
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return paths, nil
+}
+
+// fetchLayer returns the local path of the layer blob identified by
+// digest, serving it from the content-addressable cache when a
+// verified copy is already there and downloading (or resuming a
+// partial download) it otherwise.
+func fetchLayer(ref Reference, token, digest string) (string, error) {
+	path, err := blobPath(digest)
+	if err != nil {
+		return "", err
+	}
+
+	if verifyDigest(path, digest) {
+		logProgress(digest, "already cached")
+		return path, nil
+	}
+
+	if err := downloadToCache(ref, token, digest, path); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// blobPath returns the cache path for a "sha256:<hex>" digest, under
+// $XDG_CACHE_HOME/my-docker/blobs/sha256 (os.UserCacheDir()'s platform
+// default when XDG_CACHE_HOME isn't set), creating the directory if
+// needed.
+func blobPath(digest string) (string, error) {
+	digestHex, ok := strings.CutPrefix(digest, "sha256:")
+	if !ok {
+		return "", fmt.Errorf("unsupported digest algorithm: %s", digest)
+	}
+
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("error locating cache directory: %w", err)
+	}
+
+	dir := filepath.Join(base, "my-docker", "blobs", "sha256")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("error creating cache directory %s: %w", dir, err)
+	}
+
+	return filepath.Join(dir, digestHex), nil
+}
+
+// verifyDigest reports whether the file at path exists and its SHA-256
+// matches digest.
+func verifyDigest(path, digest string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return false
+	}
+
+	return "sha256:"+hex.EncodeToString(h.Sum(nil)) == digest
+}
+
+// downloadToCache downloads digest into path, resuming from a
+// previous partial download (path+".part") via an HTTP Range request
+// when one exists, stream-verifying the SHA-256 as it writes. The
+// partial file is removed and an error returned on a hash mismatch;
+// path is only populated once the digest has been confirmed.
+func downloadToCache(ref Reference, token, digest, path string) error {
+	partial := path + ".part"
+
+	var offset int64
+	if info, err := os.Stat(partial); err == nil {
+		offset = info.Size()
+	}
+
+	req, err := http.NewRequest("GET", blobURL(ref, digest), nil)
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error downloading layer %s: %w", digest, err)
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		logProgress(digest, fmt.Sprintf("resuming from %d bytes", offset))
+		flags |= os.O_APPEND
+	case http.StatusOK:
+		offset = 0
+		flags |= os.O_TRUNC
+		logProgress(digest, "downloading")
+	default:
+		return fmt.Errorf("error downloading layer %s (status: %s)", digest, resp.Status)
+	}
+
+	out, err := os.OpenFile(partial, flags, 0o644)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %w", partial, err)
+	}
+
+	hasher := sha256.New()
+	if offset > 0 {
+		if err := hashExistingBytes(hasher, partial, offset); err != nil {
+			out.Close()
+			return err
+		}
+	}
+
+	_, err = io.Copy(io.MultiWriter(out, hasher), resp.Body)
+	out.Close()
+	if err != nil {
+		return fmt.Errorf("error writing %s: %w", partial, err)
+	}
+
+	sum := "sha256:" + hex.EncodeToString(hasher.Sum(nil))
+	if sum != digest {
+		os.Remove(partial)
+		return fmt.Errorf("layer %s failed verification (got %s)", digest, sum)
+	}
+
+	logProgress(digest, "verified")
+	return os.Rename(partial, path)
+}
+
+// hashExistingBytes feeds the first n bytes already on disk at path
+// into h, so a resumed download's hash covers the whole blob rather
+// than just the part fetched this run.
+func hashExistingBytes(h io.Writer, path string, n int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error reopening %s: %w", path, err)
+	}
+	defer f.Close()
+
+	_, err = io.CopyN(h, f, n)
+	return err
+}
+
+// logProgress reports a per-blob status line to stderr, keyed by a
+// shortened digest, so it doesn't interleave with the container's own
+// stdout.
+func logProgress(digest, status string) {
+	short := strings.TrimPrefix(digest, "sha256:")
+	if len(short) > 12 {
+		short = short[:12]
+	}
+	fmt.Fprintf(os.Stderr, "%s: %s\n", short, status)
+}
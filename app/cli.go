@@ -0,0 +1,128 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RunArgs is the parsed form of:
+//
+//	your_docker.sh run [--platform os/arch] [-e KEY=VALUE ...] [--entrypoint cmd] <image> [command] [arg ...]
+type RunArgs struct {
+	Image         string
+	CommandGiven  bool
+	Command       string
+	Args          []string
+	Platform      string
+	Env           []string
+	Entrypoint    []string
+	EntrypointSet bool
+}
+
+// parseRunArgs extracts the run subcommand's flags from argv (which may
+// appear anywhere, before or after the image name) and whatever's left
+// over as the image/command/args.
+func parseRunArgs(argv []string) (RunArgs, error) {
+	var result RunArgs
+	var positional []string
+
+	for i := 0; i < len(argv); i++ {
+		arg := argv[i]
+		switch {
+		case arg == "--platform":
+			if i+1 >= len(argv) {
+				return result, fmt.Errorf("--platform requires a value")
+			}
+			result.Platform = argv[i+1]
+			i++
+		case strings.HasPrefix(arg, "--platform="):
+			result.Platform = strings.TrimPrefix(arg, "--platform=")
+		case arg == "-e" || arg == "--env":
+			if i+1 >= len(argv) {
+				return result, fmt.Errorf("%s requires a value", arg)
+			}
+			result.Env = append(result.Env, argv[i+1])
+			i++
+		case strings.HasPrefix(arg, "-e="):
+			result.Env = append(result.Env, strings.TrimPrefix(arg, "-e="))
+		case strings.HasPrefix(arg, "--env="):
+			result.Env = append(result.Env, strings.TrimPrefix(arg, "--env="))
+		case arg == "--entrypoint":
+			if i+1 >= len(argv) {
+				return result, fmt.Errorf("--entrypoint requires a value")
+			}
+			result.Entrypoint = strings.Fields(argv[i+1])
+			result.EntrypointSet = true
+			i++
+		case strings.HasPrefix(arg, "--entrypoint="):
+			result.Entrypoint = strings.Fields(strings.TrimPrefix(arg, "--entrypoint="))
+			result.EntrypointSet = true
+		default:
+			positional = append(positional, arg)
+		}
+	}
+
+	if len(positional) == 0 {
+		return result, fmt.Errorf("usage: your_docker.sh run [flags] <image> [command] [arg ...]")
+	}
+
+	result.Image = positional[0]
+	if len(positional) > 1 {
+		result.CommandGiven = true
+		result.Command = positional[1]
+		result.Args = positional[2:]
+	}
+
+	return result, nil
+}
+
+// resolveArgv merges the CLI's command/entrypoint overrides with the
+// image config's defaults per Docker semantics: a user-supplied command
+// replaces Cmd but leaves Entrypoint alone unless --entrypoint was also
+// passed, in which case that replaces Entrypoint.
+func resolveArgv(run RunArgs, config ImageConfig) []string {
+	entrypoint := config.Entrypoint
+	if run.EntrypointSet {
+		entrypoint = run.Entrypoint
+	}
+
+	cmd := config.Cmd
+	if run.CommandGiven {
+		cmd = append([]string{run.Command}, run.Args...)
+	}
+
+	return append(append([]string{}, entrypoint...), cmd...)
+}
+
+// mergeEnv applies overrides on top of base, keyed by the part of each
+// "KEY=VALUE" entry before the "=", preserving base's ordering for keys
+// it doesn't touch.
+func mergeEnv(base, overrides []string) []string {
+	merged := append([]string{}, base...)
+	for _, override := range overrides {
+		key := envKey(override)
+		replaced := false
+		for i, existing := range merged {
+			if envKey(existing) == key {
+				merged[i] = override
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			merged = append(merged, override)
+		}
+	}
+
+	return merged
+}
+
+func envKey(kv string) string {
+	if i := strings.IndexByte(kv, '='); i != -1 {
+		return kv[:i]
+	}
+	return kv
+}
@@ -0,0 +1,105 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ImageConfig is the subset of the OCI/Docker image config JSON
+// (https://github.com/opencontainers/image-spec/blob/main/config.md)
+// that determines how a container is started when the CLI doesn't
+// override it.
+type ImageConfig struct {
+	Env        []string `json:"Env"`
+	Entrypoint []string `json:"Entrypoint"`
+	Cmd        []string `json:"Cmd"`
+	WorkingDir string   `json:"WorkingDir"`
+	User       string   `json:"User"`
+}
+
+type imageConfigBlob struct {
+	Config ImageConfig `json:"config"`
+}
+
+// getImageConfig downloads and decodes the image config blob referenced
+// by the resolved manifest's Config.Digest.
+func getImageConfig(ref Reference, token, digest string) (ImageConfig, error) {
+	resp, err := downloadLayer(ref, token, digest)
+	if err != nil {
+		return ImageConfig{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ImageConfig{}, fmt.Errorf("error downloading image config (status: %s)", resp.Status)
+	}
+
+	var blob imageConfigBlob
+	if err := json.NewDecoder(resp.Body).Decode(&blob); err != nil {
+		return ImageConfig{}, fmt.Errorf("error decoding image config: %w", err)
+	}
+
+	return blob.Config, nil
+}
+
+// resolveUser turns a config "User" value - "uid[:gid]" or a bare name -
+// into the "uid[:gid]" form Run expects, resolving names against the
+// extracted rootfs's /etc/passwd. A numeric uid is returned as given,
+// with its group part if it had one; a group part is never looked up,
+// so a group name is passed through as is.
+func resolveUser(rootfs, user string) (string, error) {
+	if user == "" {
+		return "", nil
+	}
+
+	name, group, _ := strings.Cut(user, ":")
+	if _, err := strconv.Atoi(name); err == nil {
+		if group == "" {
+			return name, nil
+		}
+		return name + ":" + group, nil
+	}
+
+	uid, gid, err := lookupPasswd(rootfs, name)
+	if err != nil {
+		return "", err
+	}
+	if group != "" {
+		return fmt.Sprintf("%d:%s", uid, group), nil
+	}
+	return fmt.Sprintf("%d:%d", uid, gid), nil
+}
+
+func lookupPasswd(rootfs, name string) (uid, gid int, err error) {
+	data, err := os.ReadFile(filepath.Join(rootfs, "etc", "passwd"))
+	if err != nil {
+		return 0, 0, fmt.Errorf("error resolving user %q: %w", name, err)
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 4 || fields[0] != name {
+			continue
+		}
+
+		uid, err = strconv.Atoi(fields[2])
+		if err != nil {
+			return 0, 0, fmt.Errorf("error parsing uid for %q: %w", name, err)
+		}
+		gid, err = strconv.Atoi(fields[3])
+		if err != nil {
+			return 0, 0, fmt.Errorf("error parsing gid for %q: %w", name, err)
+		}
+		return uid, gid, nil
+	}
+
+	return 0, 0, fmt.Errorf("user %q not found in /etc/passwd", name)
+}
@@ -0,0 +1,245 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// reexecMarker is passed as argv[1] to re-invoke this same binary inside
+// the namespaces created for the child process. Cloneflags on
+// SysProcAttr only take effect for the cloned child, so the mount/
+// pivot_root work to bootstrap the container can't happen in the parent
+// - it has to run here, before the child hands off to the real command.
+const reexecMarker = "__container_init__"
+
+// RunOptions configures how Run launches a namespaced process.
+type RunOptions struct {
+	RootFS     string
+	Command    string
+	Args       []string
+	Hostname   string
+	Env        []string
+	WorkingDir string
+	User       string // uid[:gid], resolved numerically
+	Network    bool   // also unshare CLONE_NEWNET; off by default since it leaves the container without connectivity
+}
+
+// Run unshares PID/mount/UTS/IPC namespaces (and network, if requested),
+// then re-execs itself so the bootstrap in runContainerInit happens
+// inside those namespaces: mounting a fresh /proc, /sys, /dev and tmpfs
+// /tmp under RootFS, pivoting into it, and setting the hostname, before
+// finally exec'ing Command.
+func Run(opts RunOptions) error {
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("error locating own binary: %w", err)
+	}
+
+	cmd := exec.Command(self, append([]string{reexecMarker, opts.Command}, opts.Args...)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(opts.Env,
+		"MY_DOCKER_ROOTFS="+opts.RootFS,
+		"MY_DOCKER_HOSTNAME="+opts.Hostname,
+		"MY_DOCKER_WORKDIR="+opts.WorkingDir,
+		"MY_DOCKER_USER="+opts.User,
+	)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: opts.cloneFlags()}
+
+	return cmd.Run()
+}
+
+func (opts RunOptions) cloneFlags() uintptr {
+	flags := uintptr(syscall.CLONE_NEWPID | syscall.CLONE_NEWNS | syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC)
+	if opts.Network {
+		flags |= syscall.CLONE_NEWNET
+	}
+	return flags
+}
+
+// isContainerInit reports whether the process was re-exec'd by Run to
+// finish container bootstrap, based on argv[1].
+func isContainerInit(args []string) bool {
+	return len(args) > 0 && args[0] == reexecMarker
+}
+
+// runContainerInit performs the bootstrap that has to happen inside the
+// new namespaces (mounts, pivot_root, hostname) and then execs the real
+// command in place of this process.
+func runContainerInit(command string, args []string) error {
+	if err := mountRootfs(os.Getenv("MY_DOCKER_ROOTFS")); err != nil {
+		return err
+	}
+
+	if hostname := os.Getenv("MY_DOCKER_HOSTNAME"); hostname != "" {
+		if err := syscall.Sethostname([]byte(hostname)); err != nil {
+			return fmt.Errorf("error setting hostname: %w", err)
+		}
+	}
+
+	if workdir := os.Getenv("MY_DOCKER_WORKDIR"); workdir != "" {
+		if err := os.Chdir(workdir); err != nil {
+			return fmt.Errorf("error changing to workdir %s: %w", workdir, err)
+		}
+	}
+
+	if user := os.Getenv("MY_DOCKER_USER"); user != "" {
+		if err := applyUser(user); err != nil {
+			return err
+		}
+	}
+
+	binary, err := exec.LookPath(command)
+	if err != nil {
+		binary = command
+	}
+
+	env := os.Environ()
+	for _, prefix := range []string{"MY_DOCKER_ROOTFS=", "MY_DOCKER_HOSTNAME=", "MY_DOCKER_WORKDIR=", "MY_DOCKER_USER="} {
+		env = removeEnv(env, prefix)
+	}
+
+	return syscall.Exec(binary, append([]string{command}, args...), env)
+}
+
+func removeEnv(env []string, prefix string) []string {
+	filtered := env[:0]
+	for _, e := range env {
+		if !strings.HasPrefix(e, prefix) {
+			filtered = append(filtered, e)
+		}
+	}
+	return filtered
+}
+
+// applyUser switches the process to uid[:gid] before exec'ing the
+// container command. Resolving bare usernames against the rootfs's
+// /etc/passwd is handled separately once the image config is in play.
+func applyUser(user string) error {
+	parts := strings.SplitN(user, ":", 2)
+	uid, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return fmt.Errorf("error parsing user %q: %w", user, err)
+	}
+
+	gid := uid
+	if len(parts) == 2 {
+		gid, err = strconv.Atoi(parts[1])
+		if err != nil {
+			return fmt.Errorf("error parsing group in user %q: %w", user, err)
+		}
+	}
+
+	// Drop the host process's supplementary groups before switching
+	// uid/gid - otherwise the container keeps whatever groups its
+	// (usually root) parent carried, which can grant access to
+	// group-readable files the target user shouldn't have.
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("error clearing supplementary groups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("error setting gid %d: %w", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("error setting uid %d: %w", uid, err)
+	}
+
+	return nil
+}
+
+type deviceNode struct {
+	name         string
+	major, minor uint32
+	mode         uint32
+}
+
+var defaultDevices = []deviceNode{
+	{"null", 1, 3, 0o666},
+	{"zero", 1, 5, 0o666},
+	{"random", 1, 8, 0o666},
+	{"urandom", 1, 9, 0o666},
+	{"tty", 5, 0, 0o666},
+}
+
+// mountRootfs bootstraps the namespaced filesystem view: it makes the
+// mount tree private, bind-mounts rootfs onto itself so pivot_root
+// accepts it, pivots into it, and mounts /proc, /sys, /dev (with a
+// handful of device nodes) and a tmpfs /tmp, mirroring what a real
+// container runtime sets up before handing off to the container's init.
+func mountRootfs(rootfs string) error {
+	if rootfs == "" {
+		return fmt.Errorf("mountRootfs: empty rootfs")
+	}
+
+	if err := syscall.Mount("", "/", "", syscall.MS_PRIVATE|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("error making mounts private: %w", err)
+	}
+
+	if err := syscall.Mount(rootfs, rootfs, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("error bind-mounting rootfs %s: %w", rootfs, err)
+	}
+
+	oldRoot := filepath.Join(rootfs, ".old_root")
+	if err := os.MkdirAll(oldRoot, 0o700); err != nil {
+		return fmt.Errorf("error creating pivot_root staging dir: %w", err)
+	}
+
+	if err := syscall.PivotRoot(rootfs, oldRoot); err != nil {
+		return fmt.Errorf("error pivoting root to %s: %w", rootfs, err)
+	}
+
+	if err := os.Chdir("/"); err != nil {
+		return fmt.Errorf("error changing to new root: %w", err)
+	}
+
+	if err := os.MkdirAll("/proc", 0o555); err != nil {
+		return err
+	}
+	if err := syscall.Mount("proc", "/proc", "proc", 0, ""); err != nil {
+		return fmt.Errorf("error mounting /proc: %w", err)
+	}
+
+	if err := os.MkdirAll("/sys", 0o555); err != nil {
+		return err
+	}
+	if err := syscall.Mount("sysfs", "/sys", "sysfs", 0, ""); err != nil {
+		return fmt.Errorf("error mounting /sys: %w", err)
+	}
+
+	if err := os.MkdirAll("/dev", 0o755); err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", "/dev", "tmpfs", syscall.MS_NOSUID, "mode=755"); err != nil {
+		return fmt.Errorf("error mounting /dev: %w", err)
+	}
+	for _, dev := range defaultDevices {
+		path := filepath.Join("/dev", dev.name)
+		devNum := int((dev.major << 8) | dev.minor)
+		if err := syscall.Mknod(path, syscall.S_IFCHR|dev.mode, devNum); err != nil {
+			return fmt.Errorf("error creating device node %s: %w", path, err)
+		}
+	}
+
+	if err := os.MkdirAll("/tmp", 0o1777); err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", "/tmp", "tmpfs", 0, ""); err != nil {
+		return fmt.Errorf("error mounting /tmp: %w", err)
+	}
+
+	oldRootUnderNewRoot := "/.old_root"
+	if err := syscall.Unmount(oldRootUnderNewRoot, syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("error unmounting old root: %w", err)
+	}
+
+	return os.RemoveAll(oldRootUnderNewRoot)
+}
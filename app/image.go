@@ -0,0 +1,132 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const (
+	defaultRegistry  = "registry.hub.docker.com"
+	defaultNamespace = "library"
+)
+
+// Reference identifies an image pulled from a registry, e.g.
+// "gcr.io/distroless/base:latest" or "ubuntu@sha256:...".
+type Reference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// String renders the reference the way it would be resolved for pulling,
+// i.e. with the registry and any implied "library/" namespace filled in.
+func (r Reference) String() string {
+	id := r.Tag
+	if r.Digest != "" {
+		id = r.Digest
+	}
+	return fmt.Sprintf("%s/%s:%s", r.Registry, r.Repository, id)
+}
+
+// identifier returns the tag or digest to request the manifest for,
+// preferring the digest when the reference is pinned.
+func (r Reference) identifier() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+// looksLikeRegistry matches the first path segment of an image reference
+// against Docker's own rule for telling a registry host apart from a
+// namespace: it's a registry if it's "localhost", contains a ".", or
+// carries a ":port" suffix - an undotted host like "registry:5000" must
+// still be recognized, not just "my.registry.example".
+var looksLikeRegistry = regexp.MustCompile(`^(localhost|[\w-]+\.[\w.-]*|[\w-]+(\.[\w-]+)*:\d+)$`)
+
+// parseImage parses a full image reference of the form
+// [registry[:port]/][namespace/]name[:tag|@digest], defaulting to Docker
+// Hub's "library" namespace when no registry or namespace is given.
+func parseImage(arg string) Reference {
+	ref := Reference{Registry: defaultRegistry}
+
+	name := arg
+	if digestParts := strings.SplitN(arg, "@", 2); len(digestParts) == 2 {
+		name, ref.Digest = digestParts[0], digestParts[1]
+	}
+
+	parts := strings.Split(name, "/")
+	if len(parts) > 1 && looksLikeRegistry.MatchString(parts[0]) {
+		ref.Registry = parts[0]
+		parts = parts[1:]
+	}
+
+	repository := strings.Join(parts, "/")
+	if ref.Digest == "" {
+		if i := strings.LastIndex(repository, ":"); i != -1 && !strings.Contains(repository[i:], "/") {
+			repository, ref.Tag = repository[:i], repository[i+1:]
+		}
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = "latest"
+	}
+
+	if ref.Registry == defaultRegistry && !strings.Contains(repository, "/") {
+		repository = fmt.Sprintf("%s/%s", defaultNamespace, repository)
+	}
+	ref.Repository = repository
+
+	return ref
+}
+
+// authChallenge is the parsed form of a WWW-Authenticate: Bearer header.
+type authChallenge struct {
+	Realm   string
+	Service string
+	Scope   string
+}
+
+var challengeParamPattern = regexp.MustCompile(`([a-zA-Z]+)="([^"]*)"`)
+
+// discoverAuth makes an unauthenticated HEAD request to the registry's
+// /v2/ endpoint and parses the Bearer challenge out of the resulting
+// WWW-Authenticate header, so we know where to fetch tokens from without
+// hardcoding auth.docker.io for every registry.
+func discoverAuth(registry string) (authChallenge, error) {
+	url := fmt.Sprintf("https://%s/v2/", registry)
+	resp, err := httpClient.Head(url)
+	if err != nil {
+		return authChallenge{}, fmt.Errorf("error probing registry %s: %w", registry, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		// Registry doesn't require auth at all.
+		return authChallenge{}, nil
+	}
+
+	header := resp.Header.Get("WWW-Authenticate")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return authChallenge{}, fmt.Errorf("unsupported auth challenge from %s: %q", registry, header)
+	}
+
+	challenge := authChallenge{}
+	for _, match := range challengeParamPattern.FindAllStringSubmatch(header, -1) {
+		switch match[1] {
+		case "realm":
+			challenge.Realm = match[2]
+		case "service":
+			challenge.Service = match[2]
+		case "scope":
+			challenge.Scope = match[2]
+		}
+	}
+
+	return challenge, nil
+}
@@ -7,12 +7,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"net/http"
 	"os"
 	"os/exec"
-	"strings"
-	"syscall"
 	"time"
 )
 
@@ -20,13 +17,6 @@ var httpClient = &http.Client{
 	Timeout: 10 * time.Second,
 }
 
-const (
-	getTokenURL       = "https://auth.docker.io/token?service=registry.docker.io&scope=repository:%s:pull"
-	getManifestURL    = "https://registry.hub.docker.com/v2/library/%s/manifests/%s"
-	getLayerURL       = "https://registry.hub.docker.com/v2/library/%s/blobs/%s"
-	contentTypeHeader = "application/vnd.docker.distribution.manifest.v2+json"
-)
-
 type TokenResponse struct {
 	Token     string    `json:"token"`
 	AuthToken string    `json:"access_token"`
@@ -42,18 +32,23 @@ type ManifestResponse struct {
 		Size      int    `json:"size"`
 		Digest    string `json:"digest"`
 	} `json:"config"`
-	Layers []struct {
-		MediaType string `json:"mediaType"`
-		Size      int    `json:"size"`
-		Digest    string `json:"digest"`
-	} `json:"layers"`
+	Layers    []LayerDescriptor    `json:"layers"`
+	Manifests []ManifestDescriptor `json:"manifests,omitempty"`
 }
 
 // Usage: your_docker.sh run <image> <command> <arg1> <arg2> ...
 func main() {
-	imageName := os.Args[2]
-	command := os.Args[3]
-	args := os.Args[4:len(os.Args)]
+	if isContainerInit(os.Args[1:]) {
+		if err := runContainerInit(os.Args[2], os.Args[3:]); err != nil {
+			handleError(err)
+		}
+		return
+	}
+
+	runArgs, err := parseRunArgs(os.Args[2:])
+	if err != nil {
+		handleError(err)
+	}
 
 	dir, err := os.MkdirTemp("", "my-docker")
 	if err != nil {
@@ -62,114 +57,108 @@ func main() {
 
 	defer os.RemoveAll(dir)
 
-	image, tag := parseImage(imageName)
+	ref := parseImage(runArgs.Image)
 
-	token, err := getToken(fmt.Sprintf("library/%s", image))
+	token, err := getToken(ref, fmt.Sprintf("repository:%s:pull", ref.Repository))
 	if err != nil {
 		handleError(err)
 	}
 
-	manifest, err := getManifest(image, token, tag)
+	manifest, err := getManifest(ref, token, targetPlatform(runArgs.Platform))
 	if err != nil {
 		handleError(err)
 	}
 
-	var layerNames []string
-	for _, manifest := range manifest.Layers {
-		layer, err := pullLayers(image, token, manifest.Digest)
-		if err != nil {
-			handleError(err)
-		}
+	imageConfig, err := getImageConfig(ref, token, manifest.Config.Digest)
+	if err != nil {
+		handleError(err)
+	}
 
-		layerNames = append(layerNames, layer)
+	layerPaths, err := pullLayers(ref, token, manifest.Layers)
+	if err != nil {
+		handleError(err)
 	}
 
-	for _, layer := range layerNames {
+	for _, layer := range layerPaths {
 		err = extractTar(layer, dir)
 		if err != nil {
 			handleError(err)
 		}
 	}
 
-	err = createFileSystem(dir)
-	if err != nil {
-		handleError(err)
+	argv := resolveArgv(runArgs, imageConfig)
+	if len(argv) == 0 {
+		handleError(fmt.Errorf("no command specified: image has no Entrypoint/Cmd and none was given"))
 	}
 
-	cmd := exec.Command(command, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = os.Stdin
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Cloneflags: syscall.CLONE_NEWPID,
-	}
-	err = cmd.Run()
+	user, err := resolveUser(dir, imageConfig.User)
 	if err != nil {
 		handleError(err)
 	}
-}
 
-func extractTar(src, dest string) error {
-	cmd := exec.Command("tar", "-xzf", src, "-C", dest)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
+	err = Run(RunOptions{
+		RootFS:     dir,
+		Command:    argv[0],
+		Args:       argv[1:],
+		Hostname:   runArgs.Image,
+		Env:        mergeEnv(imageConfig.Env, runArgs.Env),
+		WorkingDir: imageConfig.WorkingDir,
+		User:       user,
+	})
 	if err != nil {
-		return err
+		handleError(err)
 	}
+}
 
-	return nil
+// blobURL builds the registry URL for a content-addressed blob (a layer
+// or the image config), identified by its digest.
+func blobURL(ref Reference, digest string) string {
+	return fmt.Sprintf("https://%s/v2/%s/blobs/%s", ref.Registry, ref.Repository, digest)
 }
 
-func pullLayers(image, token, digest string) (string, error) {
-	resp, err := downloadLayer(image, token, digest)
+// downloadLayer issues a plain (non-cached, non-resumable) GET for a
+// blob; used for the image config, which is small and fetched once.
+func downloadLayer(ref Reference, token, digest string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", blobURL(ref, digest), nil)
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("error creatign request: %w", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("error downloading layer (status: %s)", resp.Status)
-	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
 
-	return saveLayerToFile(resp.Body, digest)
+	return httpClient.Do(req)
 }
 
-func saveLayerToFile(body io.ReadCloser, digest string) (string, error) {
-	filename := fmt.Sprintf("%s.tar.gz", digest[7:])
-	layerFile, err := os.Create(filename)
+// getManifest fetches the manifest identified by ref, transparently
+// resolving manifest lists/OCI indexes to the child manifest matching
+// platform.
+func getManifest(ref Reference, token string, platform Platform) (*ManifestResponse, error) {
+	manifest, err := getManifestByID(ref, token, ref.identifier())
 	if err != nil {
-		return "", fmt.Errorf("error creating file %s: %w", filename, err)
+		return nil, err
 	}
-	defer layerFile.Close()
 
-	_, err = io.Copy(layerFile, body)
-	if err != nil {
-		return "", fmt.Errorf("error writing file %s: %w", filename, err)
+	if !isManifestList(manifest.MediaType) {
+		return manifest, nil
 	}
 
-	return filename, nil
-}
-
-func downloadLayer(image, token, digest string) (*http.Response, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf(getLayerURL, image, digest), nil)
+	child, err := selectManifest(manifest.Manifests, platform)
 	if err != nil {
-		return nil, fmt.Errorf("error creatign request: %w", err)
+		return nil, err
 	}
 
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
-
-	return httpClient.Do(req)
+	return getManifestByID(ref, token, child.Digest)
 }
 
-func getManifest(image, token, tag string) (*ManifestResponse, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf(getManifestURL, image, tag), nil)
+func getManifestByID(ref Reference, token, id string) (*ManifestResponse, error) {
+	url := fmt.Sprintf("https://%s/v2/%s/manifests/%s", ref.Registry, ref.Repository, id)
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
-	req.Header.Set("Accept", contentTypeHeader)
+	req.Header.Set("Accept", manifestAcceptHeader)
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
@@ -189,8 +178,53 @@ func getManifest(image, token, tag string) (*ManifestResponse, error) {
 	return manifest, nil
 }
 
-func getToken(image string) (string, error) {
-	resp, err := httpClient.Get(fmt.Sprintf(getTokenURL, image))
+// getToken discovers the registry's auth realm/service via discoverAuth and
+// exchanges it for a bearer token scoped to the given pull scope, e.g.
+// "repository:library/ubuntu:pull", authenticating the exchange with
+// whatever credentials ~/.docker/config.json has for the registry (a
+// credential helper or an inline auth entry). Tokens are cached per
+// (registry, repository, scope) until they expire.
+func getToken(ref Reference, scope string) (string, error) {
+	key := tokenCacheKey{registry: ref.Registry, repository: ref.Repository, scope: scope}
+	if token, ok := cachedTokenFor(key); ok {
+		return token, nil
+	}
+
+	challenge, err := discoverAuth(ref.Registry)
+	if err != nil {
+		return "", err
+	}
+	if challenge.Realm == "" {
+		// Registry doesn't require auth.
+		return "", nil
+	}
+
+	cfg, err := loadDockerConfig()
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest("GET", challenge.Realm, nil)
+	if err != nil {
+		return "", err
+	}
+
+	username, password, ok, err := registryCredentials(cfg, ref.Registry)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		req.SetBasicAuth(username, password)
+	}
+
+	query := req.URL.Query()
+	if challenge.Service != "" {
+		query.Set("service", challenge.Service)
+	}
+	query.Set("scope", scope)
+	req.URL.RawQuery = query.Encode()
+
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -205,19 +239,10 @@ func getToken(image string) (string, error) {
 		return "", err
 	}
 
+	storeToken(key, token)
 	return token.Token, nil
 }
 
-func parseImage(arg string) (string, string) {
-	parts := strings.Split(arg, ":")
-
-	if (len(parts)) == 1 {
-		return parts[0], "latest"
-	}
-
-	return parts[0], parts[1]
-}
-
 func handleError(err error) {
 	var exitError *exec.ExitError
 	if errors.As(err, &exitError) {
@@ -227,12 +252,3 @@ func handleError(err error) {
 		os.Exit(1)
 	}
 }
-
-func createFileSystem(dir string) error {
-	err := syscall.Chroot(dir)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
@@ -0,0 +1,78 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+const (
+	mediaTypeManifestV2   = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest  = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex     = "application/vnd.oci.image.index.v1+json"
+)
+
+// manifestAcceptHeader lists every media type getManifest knows how to
+// handle, so the registry can hand us a manifest list/OCI index when the
+// image is multi-arch instead of guessing which one we want.
+var manifestAcceptHeader = strings.Join([]string{
+	mediaTypeManifestV2,
+	mediaTypeManifestList,
+	mediaTypeOCIManifest,
+	mediaTypeOCIIndex,
+}, ", ")
+
+// Platform is the subset of a manifest list/index descriptor's "platform"
+// object we care about for selecting a child manifest.
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+// ManifestDescriptor is one entry of a manifest list or OCI index.
+type ManifestDescriptor struct {
+	MediaType string   `json:"mediaType"`
+	Size      int      `json:"size"`
+	Digest    string   `json:"digest"`
+	Platform  Platform `json:"platform"`
+}
+
+// LayerDescriptor is one entry of a manifest's "layers" array.
+type LayerDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Size      int    `json:"size"`
+	Digest    string `json:"digest"`
+}
+
+func isManifestList(mediaType string) bool {
+	return mediaType == mediaTypeManifestList || mediaType == mediaTypeOCIIndex
+}
+
+// targetPlatform returns the OS/architecture to select a manifest list
+// entry for: the --platform flag if one was passed, otherwise the host's.
+func targetPlatform(platformFlag string) Platform {
+	if platformFlag != "" {
+		parts := strings.SplitN(platformFlag, "/", 2)
+		if len(parts) == 2 {
+			return Platform{OS: parts[0], Architecture: parts[1]}
+		}
+	}
+
+	return Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+}
+
+// selectManifest picks the descriptor matching want out of a manifest
+// list/index's entries.
+func selectManifest(manifests []ManifestDescriptor, want Platform) (ManifestDescriptor, error) {
+	for _, m := range manifests {
+		if m.Platform.OS == want.OS && m.Platform.Architecture == want.Architecture {
+			return m, nil
+		}
+	}
+
+	return ManifestDescriptor{}, fmt.Errorf("no manifest found for platform %s/%s", want.OS, want.Architecture)
+}
@@ -0,0 +1,238 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const whiteoutPrefix = ".wh."
+const whiteoutOpaque = whiteoutPrefix + ".wh..opq"
+
+// extractTar applies a single gzipped layer tarball on top of the rootfs
+// being assembled at dest, in place of shelling out to the host's tar
+// binary. It restores file mode/ownership/mtime, symlinks and hardlinks,
+// and understands the OCI/Docker whiteout convention so later layers can
+// delete files introduced by earlier ones.
+func extractTar(src, dest string) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("error opening layer %s: %w", src, err)
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return fmt.Errorf("error reading layer %s: %w", src, err)
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading layer %s: %w", src, err)
+		}
+
+		target, err := secureJoin(dest, header.Name)
+		if err != nil {
+			return err
+		}
+
+		base := filepath.Base(target)
+		if base == whiteoutOpaque {
+			if err := clearDir(filepath.Dir(target)); err != nil {
+				return err
+			}
+			continue
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			whited := filepath.Join(filepath.Dir(target), strings.TrimPrefix(base, whiteoutPrefix))
+			if err := os.RemoveAll(whited); err != nil {
+				return fmt.Errorf("error applying whiteout for %s: %w", whited, err)
+			}
+			continue
+		}
+
+		if err := extractEntry(tr, header, target, dest); err != nil {
+			return err
+		}
+	}
+}
+
+func extractEntry(tr *tar.Reader, header *tar.Header, target, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return fmt.Errorf("error creating %s: %w", filepath.Dir(target), err)
+	}
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		// A lower layer may have left a non-directory (e.g. a symlink) at
+		// target; MkdirAll follows symlinks when checking what's already
+		// there, so without clearing it first we'd silently fall through
+		// to Chown/Chtimes-ing whatever it points to instead of a
+		// directory confined to dest.
+		if info, err := os.Lstat(target); err == nil && !info.IsDir() {
+			if err := os.Remove(target); err != nil {
+				return fmt.Errorf("error removing %s: %w", target, err)
+			}
+		}
+		if err := os.MkdirAll(target, os.FileMode(header.Mode)); err != nil {
+			return fmt.Errorf("error creating directory %s: %w", target, err)
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		// A file may already exist from a lower layer; remove it so we
+		// don't e.g. try to write through a symlink it left behind.
+		os.Remove(target)
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode))
+		if err != nil {
+			return fmt.Errorf("error creating file %s: %w", target, err)
+		}
+		_, err = io.Copy(out, tr)
+		out.Close()
+		if err != nil {
+			return fmt.Errorf("error writing file %s: %w", target, err)
+		}
+	case tar.TypeSymlink:
+		os.Remove(target)
+		if err := os.Symlink(header.Linkname, target); err != nil {
+			return fmt.Errorf("error creating symlink %s: %w", target, err)
+		}
+		return nil // symlink ownership/mtime can't be set portably; leave as created
+	case tar.TypeLink:
+		linkTarget, err := secureJoin(dest, header.Linkname)
+		if err != nil {
+			return err
+		}
+		os.Remove(target)
+		if err := os.Link(linkTarget, target); err != nil {
+			return fmt.Errorf("error creating hardlink %s: %w", target, err)
+		}
+		return nil
+	default:
+		return nil
+	}
+
+	if err := os.Chown(target, header.Uid, header.Gid); err != nil {
+		return fmt.Errorf("error setting owner of %s: %w", target, err)
+	}
+	mtime := header.ModTime
+	if mtime.IsZero() {
+		mtime = time.Now()
+	}
+	if err := os.Chtimes(target, mtime, mtime); err != nil {
+		return fmt.Errorf("error setting mtime of %s: %w", target, err)
+	}
+
+	return nil
+}
+
+// clearDir implements the ".wh..wh..opq" opaque whiteout: everything
+// already extracted into dir from lower layers is removed so only this
+// layer's entries remain.
+func clearDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("error clearing opaque directory %s: %w", dir, err)
+	}
+
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return fmt.Errorf("error clearing opaque directory %s: %w", dir, err)
+		}
+	}
+
+	return nil
+}
+
+// secureJoin resolves name against dest the way a chroot would: it walks
+// the path component by component, clamping ".." to dest and, for every
+// component except the last, re-resolving through dest whenever that
+// component is itself a symlink already extracted by an earlier entry.
+// Without this, a malicious layer could plant a symlink ("x" -> "/")
+// and use a later entry ("x/etc/passwd") to have its literal, lexically
+// dest-contained path actually resolve - and be written - outside dest
+// on the host. The final component is never followed, since callers
+// remove/replace whatever is already there (e.g. a file overwriting a
+// symlink left by a lower layer).
+func secureJoin(dest, name string) (string, error) {
+	dest = filepath.Clean(dest)
+
+	var current string // resolved so far, slash-separated, relative to dest
+	remaining := filepath.ToSlash(name)
+	links := 0
+
+	for remaining != "" {
+		var component string
+		if i := strings.IndexByte(remaining, '/'); i >= 0 {
+			component, remaining = remaining[:i], remaining[i+1:]
+		} else {
+			component, remaining = remaining, ""
+		}
+
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			current = secureJoinParent(current)
+			continue
+		}
+
+		candidate := filepath.Join(current, component)
+		if remaining == "" {
+			current = candidate
+			break
+		}
+
+		info, err := os.Lstat(filepath.Join(dest, candidate))
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			current = candidate
+			continue
+		}
+
+		links++
+		if links > 255 {
+			return "", fmt.Errorf("too many levels of symbolic links resolving %q", name)
+		}
+
+		link, err := os.Readlink(filepath.Join(dest, candidate))
+		if err != nil {
+			return "", fmt.Errorf("error reading symlink %s: %w", filepath.Join(dest, candidate), err)
+		}
+
+		if filepath.IsAbs(link) {
+			current = ""
+		} else {
+			current = secureJoinParent(candidate)
+		}
+		remaining = filepath.ToSlash(link) + "/" + remaining
+	}
+
+	return filepath.Join(dest, current), nil
+}
+
+// secureJoinParent returns the parent of a dest-relative path built up by
+// secureJoin, clamped to "" (dest itself) instead of escaping above it.
+func secureJoinParent(path string) string {
+	if path == "" {
+		return ""
+	}
+	if parent := filepath.Dir(path); parent != "." {
+		return parent
+	}
+	return ""
+}